@@ -0,0 +1,304 @@
+package docker
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+)
+
+const (
+	mediaTypeOCIManifest      = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIImageConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeCosignSimpleSign = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// simpleSigningPayload is the "simple signing" envelope cosign signs: it
+// binds a signature to an exact docker-reference + manifest digest pair.
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional,omitempty"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Size        int64             `json:"size"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// cosignSignatureTag is the tag cosign publishes signatures under:
+// sha256-<hex>.sig for a sha256:<hex> manifest digest.
+func cosignSignatureTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+// signAndPushImage builds a simple-signing payload for imageRef@digest,
+// signs it with the ECDSA key described by signConfig, and pushes it to the
+// registry as an OCI artifact under the cosign signature tag.
+func signAndPushImage(rc *registryClient, repository, imageRef, digest string, signConfig map[string]interface{}) error {
+	key, err := loadCosignPrivateKey(signConfig["cosign_key"].(string), signConfig["cosign_password_env"].(string))
+	if err != nil {
+		return fmt.Errorf("error loading cosign key: %s", err)
+	}
+
+	annotations := map[string]string{}
+	for k, v := range signConfig["annotations"].(map[string]interface{}) {
+		annotations[k] = v.(string)
+	}
+
+	payload := simpleSigningPayload{Optional: annotations}
+	payload.Critical.Type = "cosign container image signature"
+	payload.Critical.Identity.DockerReference = imageRef
+	payload.Critical.Image.DockerManifestDigest = digest
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling signature payload: %s", err)
+	}
+
+	signature, err := signPayload(key, payloadBytes)
+	if err != nil {
+		return fmt.Errorf("error signing payload: %s", err)
+	}
+
+	layerDigest, err := rc.uploadBlob(repository, payloadBytes)
+	if err != nil {
+		return fmt.Errorf("error uploading signature payload: %s", err)
+	}
+
+	configBytes := []byte("{}")
+	configDigest, err := rc.uploadBlob(repository, configBytes)
+	if err != nil {
+		return fmt.Errorf("error uploading signature config: %s", err)
+	}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config: ociDescriptor{
+			MediaType: mediaTypeOCIImageConfig,
+			Size:      int64(len(configBytes)),
+			Digest:    configDigest,
+		},
+		Layers: []ociDescriptor{
+			{
+				MediaType: mediaTypeCosignSimpleSign,
+				Size:      int64(len(payloadBytes)),
+				Digest:    layerDigest,
+				Annotations: map[string]string{
+					cosignSignatureAnnotation: signature,
+				},
+			},
+		},
+		Annotations: annotations,
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("error marshaling signature manifest: %s", err)
+	}
+
+	_, err = rc.putManifest(repository, cosignSignatureTag(digest), mediaTypeOCIManifest, manifestBytes)
+	return err
+}
+
+// verifyImageSignature fetches the cosign signature artifact for digest and
+// validates it against any of publicKeyPaths, succeeding as soon as one key
+// verifies. A valid signature isn't enough on its own: it also has to be
+// signing imageRef@digest specifically, otherwise a signature legitimately
+// issued for a different image could be copied onto this one's signature
+// tag and verify successfully.
+func verifyImageSignature(rc *registryClient, repository, imageRef, digest string, publicKeyPaths []string) error {
+	_, manifestBytes, err := rc.getManifest(repository, cosignSignatureTag(digest), mediaTypeOCIManifest)
+	if err != nil {
+		return fmt.Errorf("error fetching signature artifact: %s", err)
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return fmt.Errorf("error parsing signature artifact: %s", err)
+	}
+	if len(manifest.Layers) == 0 {
+		return fmt.Errorf("signature artifact has no layers")
+	}
+
+	layer := manifest.Layers[0]
+	signature := layer.Annotations[cosignSignatureAnnotation]
+	if signature == "" {
+		return fmt.Errorf("signature artifact is missing the %s annotation", cosignSignatureAnnotation)
+	}
+
+	payloadBytes, err := rc.getBlob(repository, layer.Digest)
+	if err != nil {
+		return fmt.Errorf("error fetching signature payload: %s", err)
+	}
+
+	var payload simpleSigningPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return fmt.Errorf("error parsing signature payload: %s", err)
+	}
+	if payload.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signature payload is for digest %s, not %s", payload.Critical.Image.DockerManifestDigest, digest)
+	}
+	if payload.Critical.Identity.DockerReference != imageRef {
+		return fmt.Errorf("signature payload is for %s, not %s", payload.Critical.Identity.DockerReference, imageRef)
+	}
+
+	var verifyErr error
+	for _, path := range publicKeyPaths {
+		key, err := loadCosignPublicKey(path)
+		if err != nil {
+			verifyErr = err
+			continue
+		}
+		if err := verifyPayload(key, payloadBytes, signature); err == nil {
+			return nil
+		}
+		verifyErr = fmt.Errorf("signature did not verify against %s", path)
+	}
+
+	if verifyErr == nil {
+		verifyErr = fmt.Errorf("no public_keys configured")
+	}
+	return verifyErr
+}
+
+func signPayload(key *ecdsa.PrivateKey, payload []byte) (string, error) {
+	hash := sha256.Sum256(payload)
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	asn1Sig, err := asn1.Marshal(ecdsaSignature{R: r, S: s})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(asn1Sig), nil
+}
+
+func verifyPayload(key *ecdsa.PublicKey, payload []byte, signatureB64 string) error {
+	sigBytes, err := base64.StdEncoding.DecodeString(signatureB64)
+	if err != nil {
+		return fmt.Errorf("error decoding signature: %s", err)
+	}
+
+	var sig ecdsaSignature
+	if _, err := asn1.Unmarshal(sigBytes, &sig); err != nil {
+		return fmt.Errorf("error parsing signature: %s", err)
+	}
+
+	hash := sha256.Sum256(payload)
+	if !ecdsa.Verify(key, hash[:], sig.R, sig.S) {
+		return fmt.Errorf("signature verification failed")
+	}
+
+	return nil
+}
+
+func loadCosignPrivateKey(path, passwordEnv string) (*ecdsa.PrivateKey, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+
+	// `cosign generate-key-pair` encrypts its private key with sigstore's
+	// own scrypt+NaCl scheme under an "ENCRYPTED COSIGN PRIVATE KEY" PEM
+	// block, which x509.DecryptPEMBlock below cannot read (it only
+	// understands the legacy PEM DEK-Info encryption). cosign_key only
+	// accepts a plain, unencrypted standard-PEM ECDSA key, or one encrypted
+	// with that legacy scheme; decrypt a cosign-native key once ahead of
+	// time (e.g. `cosign import-key-pair`) before pointing cosign_key at it.
+	if block.Type == "ENCRYPTED COSIGN PRIVATE KEY" {
+		return nil, fmt.Errorf("%s is a cosign-native encrypted key; cosign_key does not support sigstore's scrypt+NaCl encrypted format, decrypt it to a plain PEM EC private key first", path)
+	}
+
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		if passwordEnv == "" {
+			return nil, fmt.Errorf("%s is encrypted but cosign_password_env was not set", path)
+		}
+		der, err = x509.DecryptPEMBlock(block, []byte(os.Getenv(passwordEnv)))
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting %s: %s", path, err)
+		}
+	}
+
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing EC private key: %s", err)
+	}
+
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an ECDSA private key", path)
+	}
+
+	return key, nil
+}
+
+func loadCosignPublicKey(path string) (*ecdsa.PublicKey, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing EC public key: %s", err)
+	}
+
+	key, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an ECDSA public key", path)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,330 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"golang.org/x/oauth2/google"
+)
+
+// credentialHelperResponse mirrors the JSON a docker-credential-* helper
+// writes to stdout per the Docker CLI credential-helper protocol.
+type credentialHelperResponse struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// credentialProvider resolves credentials for a registry when no static
+// entry is configured in AuthConfigs.
+type credentialProvider interface {
+	Credentials(registry string) (username, password string, err error)
+}
+
+// newRegistryClientForRegistry builds a registryClient for registry, using
+// any static credentials configured for it and otherwise falling back to
+// credential helpers / the built-in cloud providers.
+func newRegistryClientForRegistry(authConfig *AuthConfigs, registry string) *registryClient {
+	username, password := "", ""
+	if auth, ok := authConfig.Configs[normalizeRegistryAddress(registry)]; ok {
+		username, password = auth.Username, auth.Password
+	}
+	if username == "" {
+		if fallbackUsername, fallbackPassword, err := fallbackRegistryCredentials(registry); err == nil {
+			username, password = fallbackUsername, fallbackPassword
+		}
+	}
+	return newRegistryClient(registry, username, password)
+}
+
+// fallbackRegistryCredentials is consulted by pushImage, the image resource's
+// delete and the manifest list resource whenever a registry has no matching entry
+// in the static AuthConfigs. It tries a configured docker-credential-*
+// helper first, then falls back to built-in providers for the major cloud
+// registries, identified by hostname.
+func fallbackRegistryCredentials(registry string) (string, string, error) {
+	for _, provider := range credentialProvidersFor(registry) {
+		username, password, err := provider.Credentials(registry)
+		if err == nil && username != "" {
+			return username, password, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("no credentials available for %s", registry)
+}
+
+func credentialProvidersFor(registry string) []credentialProvider {
+	providers := []credentialProvider{credentialHelperProvider{}}
+
+	switch {
+	case strings.Contains(registry, ".dkr.ecr.") && strings.Contains(registry, ".amazonaws.com"):
+		providers = append(providers, ecrCredentialProvider{})
+	case strings.Contains(registry, "gcr.io") || strings.Contains(registry, "-docker.pkg.dev"):
+		providers = append(providers, gcrCredentialProvider{})
+	case strings.Contains(registry, ".azurecr.io"):
+		providers = append(providers, acrCredentialProvider{})
+	}
+
+	return providers
+}
+
+// credentialHelperProvider shells out to the docker-credential-* helper
+// configured for registry in ~/.docker/config.json, mirroring what the
+// Docker CLI does for credHelpers/credsStore entries.
+type credentialHelperProvider struct{}
+
+func (credentialHelperProvider) Credentials(registry string) (string, string, error) {
+	helper, err := dockerConfigCredentialHelper(registry)
+	if err != nil {
+		return "", "", err
+	}
+	if helper == "" {
+		return "", "", fmt.Errorf("no docker-credential helper configured for %s", registry)
+	}
+
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(registry)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("error invoking docker-credential-%s: %s", helper, err)
+	}
+
+	resp := &credentialHelperResponse{}
+	if err := json.Unmarshal(out, resp); err != nil {
+		return "", "", fmt.Errorf("error parsing docker-credential-%s output: %s", helper, err)
+	}
+
+	return resp.Username, resp.Secret, nil
+}
+
+// dockerConfigCredentialHelper resolves the docker-credential-* helper name
+// for registry the way the Docker CLI does: a per-registry entry in
+// credHelpers takes precedence over the global credsStore fallback. A
+// missing config file isn't an error, it just means no helper is
+// configured.
+func dockerConfigCredentialHelper(registry string) (string, error) {
+	path, err := dockerConfigPath()
+	if err != nil {
+		return "", err
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	var config struct {
+		CredHelpers map[string]string `json:"credHelpers"`
+		CredsStore  string             `json:"credsStore"`
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return "", fmt.Errorf("error parsing %s: %s", path, err)
+	}
+
+	if helper, ok := config.CredHelpers[registry]; ok {
+		return helper, nil
+	}
+	if helper, ok := config.CredHelpers[normalizeRegistryAddress(registry)]; ok {
+		return helper, nil
+	}
+
+	return config.CredsStore, nil
+}
+
+// dockerConfigPath resolves ~/.docker/config.json, honoring DOCKER_CONFIG
+// the way the Docker CLI does.
+func dockerConfigPath() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error resolving home directory: %s", err)
+	}
+
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+// ecrCredentialProvider exchanges the ambient AWS credentials for a
+// short-lived ECR authorization token.
+type ecrCredentialProvider struct{}
+
+func (ecrCredentialProvider) Credentials(registry string) (string, string, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return "", "", fmt.Errorf("error creating AWS session: %s", err)
+	}
+
+	out, err := ecr.New(sess).GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return "", "", fmt.Errorf("error getting ECR authorization token: %s", err)
+	}
+	if len(out.AuthorizationData) == 0 {
+		return "", "", fmt.Errorf("ECR returned no authorization data")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(out.AuthorizationData[0].AuthorizationToken))
+	if err != nil {
+		return "", "", fmt.Errorf("error decoding ECR authorization token: %s", err)
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("unexpected ECR authorization token format")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// gcrCredentialProvider resolves an OAuth2 access token via the GCE metadata
+// server, falling back to application default credentials, and presents it
+// as the password for the conventional "oauth2accesstoken" username.
+type gcrCredentialProvider struct{}
+
+func (gcrCredentialProvider) Credentials(registry string) (string, string, error) {
+	if token, err := gcrMetadataServerToken(); err == nil {
+		return "oauth2accesstoken", token, nil
+	}
+
+	creds, err := google.FindDefaultCredentials(context.Background(), "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return "", "", fmt.Errorf("error finding application default credentials: %s", err)
+	}
+
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return "", "", fmt.Errorf("error fetching GCP access token: %s", err)
+	}
+
+	return "oauth2accesstoken", token.AccessToken, nil
+}
+
+func gcrMetadataServerToken() (string, error) {
+	req, err := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+
+	return tokenResp.AccessToken, nil
+}
+
+// acrCredentialProvider exchanges an AAD token for an ACR refresh token,
+// which Azure Container Registry accepts as the password for the fixed
+// "00000000-0000-0000-0000-000000000000" username.
+type acrCredentialProvider struct{}
+
+func (acrCredentialProvider) Credentials(registry string) (string, string, error) {
+	aadToken, err := azureAADToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err := acrExchangeToken(registry, aadToken)
+	if err != nil {
+		return "", "", err
+	}
+
+	return "00000000-0000-0000-0000-000000000000", refreshToken, nil
+}
+
+func azureAADToken() (string, error) {
+	tenantID := os.Getenv("AZURE_TENANT_ID")
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	clientSecret := os.Getenv("AZURE_CLIENT_SECRET")
+	if tenantID == "" || clientID == "" || clientSecret == "" {
+		return "", fmt.Errorf("AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET must be set for ACR authentication")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientID)
+	form.Set("client_secret", clientSecret)
+	form.Set("resource", "https://management.azure.com/")
+
+	resp, err := http.PostForm("https://login.microsoftonline.com/"+tenantID+"/oauth2/token", form)
+	if err != nil {
+		return "", fmt.Errorf("error requesting AAD token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("AAD token request returned %s", resp.Status)
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("error parsing AAD token response: %s", err)
+	}
+
+	return tokenResp.AccessToken, nil
+}
+
+func acrExchangeToken(registry, aadToken string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "access_token")
+	form.Set("service", registry)
+	form.Set("access_token", aadToken)
+
+	resp, err := http.PostForm("https://"+registry+"/oauth2/exchange", form)
+	if err != nil {
+		return "", fmt.Errorf("error exchanging AAD token with ACR: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading ACR exchange response: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ACR token exchange returned %s: %s", resp.Status, body)
+	}
+
+	var exchangeResp struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(body, &exchangeResp); err != nil {
+		return "", fmt.Errorf("error parsing ACR exchange response: %s", err)
+	}
+
+	return exchangeResp.RefreshToken, nil
+}
@@ -0,0 +1,347 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// registryClient performs authenticated Docker Registry HTTP API v2 calls
+// against a single registry. It implements the RFC 6750 / Docker
+// token-server bearer handshake and caches the resulting tokens by the
+// caller's scope string, so a sequence of calls that share a scope (e.g. the
+// POST and PUT of a blob upload, or the tag list, manifest and config
+// fetches of a retention run) only authenticates once. Calls with different
+// scopes, such as a pull-scoped GET and a push-scoped PUT, each authenticate
+// separately.
+type registryClient struct {
+	registry   string
+	username   string
+	password   string
+	httpClient *http.Client
+	tokens     map[string]string
+}
+
+func newRegistryClient(registry, username, password string) *registryClient {
+	return &registryClient{
+		registry:   registry,
+		username:   username,
+		password:   password,
+		httpClient: registryHTTPClient(),
+		tokens:     map[string]string{},
+	}
+}
+
+// registryHTTPClient returns the *http.Client used for direct registry API
+// calls, honoring the TF_ACC insecure-registry escape hatch used by the
+// acceptance tests.
+func registryHTTPClient() *http.Client {
+	client := http.DefaultClient
+
+	if env, okEnv := os.LookupEnv("TF_ACC"); okEnv {
+		if i, errConv := strconv.Atoi(env); errConv == nil && i >= 1 {
+			client.Transport = &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}
+		}
+	}
+
+	return client
+}
+
+// request performs method against path (an absolute /v2/... path) and
+// returns the response together with its fully-read body. scope identifies
+// the resource+actions being authenticated for (e.g.
+// "repository:foo/bar:pull,push") and is used as the token cache key; on a
+// 401 challenge the token is requested for the scope the challenge
+// advertises.
+func (c *registryClient) request(method, path, scope string, headers map[string]string, body []byte) (*http.Response, []byte, error) {
+	do := func(token string) (*http.Response, error) {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+
+		req, err := http.NewRequest(method, "https://"+c.registry+path, reader)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating registry request: %s", err)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if c.username != "" {
+			req.SetBasicAuth(c.username, c.password)
+		}
+
+		return c.httpClient.Do(req)
+	}
+
+	resp, err := do(c.tokens[scope])
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error during registry request: %s", err)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && strings.HasPrefix(resp.Header.Get("www-authenticate"), "Bearer") {
+		resp.Body.Close()
+
+		token, err := c.authenticate(resp.Header.Get("www-authenticate"))
+		if err != nil {
+			return nil, nil, err
+		}
+		c.tokens[scope] = token
+
+		resp, err = do(token)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error during registry request: %s", err)
+		}
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, fmt.Errorf("Error reading response body: %s", err)
+	}
+
+	return resp, respBody, nil
+}
+
+// authenticate exchanges the registry's static or fallback-resolved
+// credentials for a short-lived Bearer token at the realm advertised by a
+// 401's www-authenticate header.
+func (c *registryClient) authenticate(wwwAuthenticate string) (string, error) {
+	auth := parseAuthHeader(wwwAuthenticate)
+	params := url.Values{}
+	params.Set("service", auth["service"])
+	params.Set("scope", auth["scope"])
+
+	req, err := http.NewRequest("GET", auth["realm"]+"?"+params.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("Error creating registry request: %s", err)
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error during registry request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Got bad response from registry: " + resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("Error reading response body: %s", err)
+	}
+
+	token := &TokenResponse{}
+	if err := json.Unmarshal(body, token); err != nil {
+		return "", fmt.Errorf("Error parsing OAuth token response: %s", err)
+	}
+
+	return token.Token, nil
+}
+
+// deleteManifest removes a manifest by tag or digest, treating both a
+// successful delete and an already-gone manifest as success.
+func (c *registryClient) deleteManifest(repository, reference string) error {
+	scope := "repository:" + repository + ":pull,delete"
+
+	resp, _, err := c.request("DELETE", "/v2/"+repository+"/manifests/"+reference, scope, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusNotFound:
+		return nil
+	case http.StatusUnauthorized:
+		return fmt.Errorf("Bad credentials: " + resp.Status)
+	default:
+		return fmt.Errorf("Got bad response from registry: " + resp.Status)
+	}
+}
+
+// getManifest fetches a manifest, returning its content digest (from the
+// Docker-Content-Digest header, falling back to a locally-computed sha256)
+// and raw body.
+func (c *registryClient) getManifest(repository, reference, accept string) (string, []byte, error) {
+	scope := "repository:" + repository + ":pull"
+
+	resp, body, err := c.request("GET", "/v2/"+repository+"/manifests/"+reference, scope, map[string]string{"Accept": accept}, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("Got bad response from registry: " + resp.Status)
+	}
+
+	return digestOrSum(resp, body), body, nil
+}
+
+// putManifest pushes a manifest document and returns its content digest.
+func (c *registryClient) putManifest(repository, reference, contentType string, body []byte) (string, error) {
+	scope := "repository:" + repository + ":pull,push"
+
+	resp, _, err := c.request("PUT", "/v2/"+repository+"/manifests/"+reference, scope, map[string]string{"Content-Type": contentType}, body)
+	if err != nil {
+		return "", err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusAccepted, http.StatusOK:
+		return digestOrSum(resp, body), nil
+	default:
+		return "", fmt.Errorf("Got bad response from registry: " + resp.Status)
+	}
+}
+
+// listTags returns every tag currently published for repository.
+func (c *registryClient) listTags(repository string) ([]string, error) {
+	scope := "repository:" + repository + ":pull"
+
+	resp, body, err := c.request("GET", "/v2/"+repository+"/tags/list", scope, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Got bad response from registry: " + resp.Status)
+	}
+
+	var tagsResponse struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal(body, &tagsResponse); err != nil {
+		return nil, fmt.Errorf("Error parsing tags list response: %s", err)
+	}
+
+	return tagsResponse.Tags, nil
+}
+
+// getBlob fetches a content-addressable blob (e.g. an image config) by
+// digest.
+func (c *registryClient) getBlob(repository, digest string) ([]byte, error) {
+	scope := "repository:" + repository + ":pull"
+
+	resp, body, err := c.request("GET", "/v2/"+repository+"/blobs/"+digest, scope, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Got bad response from registry: " + resp.Status)
+	}
+
+	return body, nil
+}
+
+// uploadBlob performs a monolithic (single-request) upload of content and
+// returns its digest. It's used for the small config/signature blobs
+// involved in pushing a cosign signature artifact; large image layers are
+// left to the Docker daemon's own push path.
+func (c *registryClient) uploadBlob(repository string, content []byte) (string, error) {
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	scope := "repository:" + repository + ":pull,push"
+
+	resp, _, err := c.request("POST", "/v2/"+repository+"/blobs/uploads/", scope, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("Got bad response from registry: " + resp.Status)
+	}
+
+	uploadPath := registryRelativePath(resp.Header.Get("Location"))
+	sep := "?"
+	if strings.Contains(uploadPath, "?") {
+		sep = "&"
+	}
+
+	putResp, _, err := c.request("PUT", uploadPath+sep+"digest="+url.QueryEscape(digest), scope, map[string]string{"Content-Type": "application/octet-stream"}, content)
+	if err != nil {
+		return "", err
+	}
+	if putResp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("Got bad response from registry: " + putResp.Status)
+	}
+
+	return digest, nil
+}
+
+// registryRelativePath strips any scheme+host prefix from a Location header
+// so the path can be re-issued through request(), which always targets
+// c.registry itself.
+func registryRelativePath(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if u.RawQuery != "" {
+		return u.Path + "?" + u.RawQuery
+	}
+	return u.Path
+}
+
+// headBlob reports whether repository already has digest, via a plain HEAD
+// probe against the blobs endpoint.
+func (c *registryClient) headBlob(repository, digest string) (bool, error) {
+	scope := "repository:" + repository + ":pull"
+
+	resp, _, err := c.request("HEAD", "/v2/"+repository+"/blobs/"+digest, scope, nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// mountBlob asks the registry to mount digest, already present in from,
+// into repository instead of re-uploading it. It returns true when the
+// registry honored the mount (201 Created); a false with a nil error means
+// the registry instead opened a normal upload session that the caller must
+// complete itself.
+func (c *registryClient) mountBlob(repository, digest, from string) (bool, error) {
+	scope := "repository:" + repository + ":pull,push"
+
+	params := url.Values{}
+	params.Set("mount", digest)
+	params.Set("from", from)
+
+	resp, _, err := c.request("POST", "/v2/"+repository+"/blobs/uploads/?"+params.Encode(), scope, nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Got bad response from registry: " + resp.Status)
+	}
+}
+
+func digestOrSum(resp *http.Response, body []byte) string {
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest
+	}
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,58 @@
+package docker
+
+import "strings"
+
+// normalizeRegistryRepository fills in the Docker Hub defaults and strips a
+// registry host prefix out of repository, mirroring how the Docker CLI
+// resolves "consul" to registry.hub.docker.com/library/consul and
+// "myreg.example.com/team/app" to myreg.example.com/team/app. Every direct
+// registry API call needs repository in this normalized form, since the
+// registry itself never sees the host part of the reference.
+func normalizeRegistryRepository(registry, repository string) (string, string) {
+	if registry == "" {
+		registry = "registry.hub.docker.com"
+	} else {
+		// Otherwise, filter the registry name out of the repo name
+		repository = strings.Replace(repository, registry+"/", "", 1)
+	}
+
+	if registry == "registry.hub.docker.com" {
+		// Docker prefixes 'library' to official images in the path; 'consul' becomes 'library/consul'
+		if !strings.Contains(repository, "/") {
+			repository = "library/" + repository
+		}
+	}
+
+	return registry, repository
+}
+
+// normalizeTag defaults an empty tag to "latest".
+func normalizeTag(tag string) string {
+	if tag == "" {
+		return "latest"
+	}
+	return tag
+}
+
+// splitRepoDigest splits a RepoDigests entry such as
+// "registry.example.com/team/app@sha256:..." or "consul@sha256:..." into its
+// normalized repository and digest parts.
+func splitRepoDigest(repoDigest string) (repository, digest string, ok bool) {
+	parts := strings.SplitN(repoDigest, "@", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	ref := parts[0]
+	registry := ""
+	if idx := strings.Index(ref, "/"); idx >= 0 {
+		host := ref[:idx]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			registry = host
+			ref = ref[idx+1:]
+		}
+	}
+
+	_, repository = normalizeRegistryRepository(registry, ref)
+	return repository, parts[1], true
+}
@@ -7,10 +7,12 @@ import (
 func resourceDockerRegistryImage() *schema.Resource {
 	return &schema.Resource{
 		Create: resourceDockerRegistryImageCreate,
-		Read:   dataSourceDockerRegistryImageRead,
+		Read:   resourceDockerRegistryImageRead,
 		Update: resourceDockerRegistryImageUpdate,
 		Delete: resourceDockerRegistryImageDelete,
 
+		CustomizeDiff: resourceDockerRegistryImageCustomizeDiff,
+
 		Schema: map[string]*schema.Schema{
 			"name": {
 				Type:     schema.TypeString,
@@ -35,6 +37,104 @@ func resourceDockerRegistryImage() *schema.Resource {
 				Type:     schema.TypeBool,
 				Optional: true,
 			},
+
+			"build": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"context": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"dockerfile": {
+							Type:     schema.TypeString,
+							Optional: true,
+							Default:  "Dockerfile",
+						},
+
+						"build_args": {
+							Type:     schema.TypeMap,
+							Optional: true,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+						},
+
+						"target": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+
+						"labels": {
+							Type:     schema.TypeMap,
+							Optional: true,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+						},
+
+						"platform": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+					},
+				},
+			},
+
+			"source_digest": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"mount_from": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			"sign": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"cosign_key": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"cosign_password_env": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+
+						"annotations": {
+							Type:     schema.TypeMap,
+							Optional: true,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+						},
+					},
+				},
+			},
+
+			"verify": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"public_keys": {
+							Type:     schema.TypeList,
+							Required: true,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+						},
+
+						"required": {
+							Type:     schema.TypeBool,
+							Optional: true,
+						},
+					},
+				},
+			},
 		},
 	}
 }
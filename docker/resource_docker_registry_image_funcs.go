@@ -1,15 +1,16 @@
 package docker
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"net/url"
+	"io"
 	"os"
-	"strconv"
-	"strings"
+	"path/filepath"
+	"sort"
 
 	"encoding/base64"
 	"encoding/json"
@@ -21,19 +22,87 @@ import (
 
 func resourceDockerRegistryImageCreate(d *schema.ResourceData, meta interface{}) error {
 	client := meta.(*ProviderConfig).DockerClient
+	authConfigs := meta.(*ProviderConfig).AuthConfigs
 
 	imageName := d.Get("name").(string)
-	err := pushImage(client, meta.(*ProviderConfig).AuthConfigs, imageName)
+
+	if v, ok := d.GetOk("build"); ok {
+		buildConfig := v.([]interface{})[0].(map[string]interface{})
+
+		digest, err := buildImage(client, buildConfig, imageName)
+		if err != nil {
+			return fmt.Errorf("Unable to build Docker image: %s", err)
+		}
+		d.Set("source_digest", digest)
+	}
+
+	mountFrom := stringListFromSchema(d.Get("mount_from").([]interface{}))
+	attemptCrossRepoMounts(client, authConfigs, imageName, mountFrom)
+
+	err := pushImage(client, authConfigs, imageName)
 	if err != nil {
 		return fmt.Errorf("Unable to push Docker image: %s", err)
 	}
 
+	if v, ok := d.GetOk("sign"); ok {
+		signConfig := v.([]interface{})[0].(map[string]interface{})
+
+		pushOpts := parseImageOptions(imageName)
+		registry, repository := normalizeRegistryRepository(pushOpts.Registry, pushOpts.Repository)
+		tag := normalizeTag(pushOpts.Tag)
+
+		rc := newRegistryClientForRegistry(authConfigs, registry)
+		digest, _, err := rc.getManifest(repository, tag, mediaTypeManifest)
+		if err != nil {
+			return fmt.Errorf("Unable to resolve pushed manifest digest: %s", err)
+		}
+
+		if err := signAndPushImage(rc, repository, imageName, digest, signConfig); err != nil {
+			return fmt.Errorf("Unable to sign Docker image: %s", err)
+		}
+	}
+
+	return resourceDockerRegistryImageRead(d, meta)
+}
+
+func resourceDockerRegistryImageRead(d *schema.ResourceData, meta interface{}) error {
+	if v, ok := d.GetOk("verify"); ok {
+		verifyConfig := v.([]interface{})[0].(map[string]interface{})
+
+		if verifyConfig["required"].(bool) {
+			authConfigs := meta.(*ProviderConfig).AuthConfigs
+			imageName := d.Get("name").(string)
+
+			pushOpts := parseImageOptions(imageName)
+			registry, repository := normalizeRegistryRepository(pushOpts.Registry, pushOpts.Repository)
+			tag := normalizeTag(pushOpts.Tag)
+
+			rc := newRegistryClientForRegistry(authConfigs, registry)
+			digest, _, err := rc.getManifest(repository, tag, mediaTypeManifest)
+			if err != nil {
+				return fmt.Errorf("Unable to resolve manifest digest for verification: %s", err)
+			}
+
+			publicKeys := stringListFromSchema(verifyConfig["public_keys"].([]interface{}))
+			if err := verifyImageSignature(rc, repository, imageName, digest, publicKeys); err != nil {
+				return fmt.Errorf("Signature verification failed for %s: %s", imageName, err)
+			}
+		}
+	}
+
 	return dataSourceDockerRegistryImageRead(d, meta)
 }
 
 func resourceDockerRegistryImageUpdate(d *schema.ResourceData, meta interface{}) error {
-	// Update only exists to enable keep_remote to be toggled.
-	return dataSourceDockerRegistryImageRead(d, meta)
+	// Update only exists to enable keep_remote to be toggled, or to rebuild
+	// and re-push the image when the build configuration changes or
+	// CustomizeDiff detected an out-of-band context change via
+	// source_digest.
+	if d.HasChange("build") || d.HasChange("source_digest") {
+		return resourceDockerRegistryImageCreate(d, meta)
+	}
+
+	return resourceDockerRegistryImageRead(d, meta)
 }
 
 func resourceDockerRegistryImageDelete(d *schema.ResourceData, meta interface{}) error {
@@ -45,24 +114,8 @@ func resourceDockerRegistryImageDelete(d *schema.ResourceData, meta interface{})
 	digest := d.Get("sha256_digest").(string)
 	authConfig := meta.(*ProviderConfig).AuthConfigs
 
-	// Use the official Docker Hub if a registry isn't specified
-	if pullOpts.Registry == "" {
-		pullOpts.Registry = "registry.hub.docker.com"
-	} else {
-		// Otherwise, filter the registry name out of the repo name
-		pullOpts.Repository = strings.Replace(pullOpts.Repository, pullOpts.Registry+"/", "", 1)
-	}
-
-	if pullOpts.Registry == "registry.hub.docker.com" {
-		// Docker prefixes 'library' to official images in the path; 'consul' becomes 'library/consul'
-		if !strings.Contains(pullOpts.Repository, "/") {
-			pullOpts.Repository = "library/" + pullOpts.Repository
-		}
-	}
-
-	if pullOpts.Tag == "" {
-		pullOpts.Tag = "latest"
-	}
+	pullOpts.Registry, pullOpts.Repository = normalizeRegistryRepository(pullOpts.Registry, pullOpts.Repository)
+	pullOpts.Tag = normalizeTag(pullOpts.Tag)
 
 	username := ""
 	password := ""
@@ -72,6 +125,15 @@ func resourceDockerRegistryImageDelete(d *schema.ResourceData, meta interface{})
 		password = auth.Password
 	}
 
+	// Fall back to credential helpers / built-in cloud providers when no
+	// static credentials matched.
+	if username == "" {
+		if fallbackUsername, fallbackPassword, err := fallbackRegistryCredentials(pullOpts.Registry); err == nil {
+			username = fallbackUsername
+			password = fallbackPassword
+		}
+	}
+
 	err := removeRegistryImage(pullOpts.Registry, pullOpts.Repository, digest, username, password)
 	if err != nil {
 		return fmt.Errorf("Unable to remove Docker image: %s", err)
@@ -81,6 +143,204 @@ func resourceDockerRegistryImageDelete(d *schema.ResourceData, meta interface{})
 	return nil
 }
 
+// buildImageOpts translates a build block's resolved config into the
+// ImageBuildOptions the Docker daemon expects.
+func buildImageOpts(buildConfig map[string]interface{}, image string) types.ImageBuildOptions {
+	buildArgs := map[string]*string{}
+	for k, v := range buildConfig["build_args"].(map[string]interface{}) {
+		value := v.(string)
+		buildArgs[k] = &value
+	}
+
+	labels := map[string]string{}
+	for k, v := range buildConfig["labels"].(map[string]interface{}) {
+		labels[k] = v.(string)
+	}
+
+	return types.ImageBuildOptions{
+		Dockerfile: buildConfig["dockerfile"].(string),
+		Tags:       []string{image},
+		BuildArgs:  buildArgs,
+		Labels:     labels,
+		Target:     buildConfig["target"].(string),
+		Platform:   buildConfig["platform"].(string),
+	}
+}
+
+// buildContextDigest hashes the on-disk build context together with the
+// resolved build options, so it changes whenever either the context's
+// contents or the build args/target/labels change, independent of the
+// resulting image ID. It's used both by buildImage, whose result is stored
+// as source_digest, and by resourceDockerRegistryImageCustomizeDiff to detect
+// an out-of-band context change at plan time.
+func buildContextDigest(buildConfig map[string]interface{}, opts types.ImageBuildOptions) (string, error) {
+	digest, err := hashBuildContext(buildConfig["context"].(string))
+	if err != nil {
+		return "", fmt.Errorf("error hashing build context %s: %s", buildConfig["context"].(string), err)
+	}
+
+	optsJSON, err := json.Marshal(opts)
+	if err != nil {
+		return "", fmt.Errorf("error hashing build options: %s", err)
+	}
+	sum := sha256.Sum256(append([]byte(digest), optsJSON...))
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// buildImage tars the build context referenced by buildConfig, builds it
+// via the Docker daemon and tags the result as image. It returns a
+// content-addressable digest of the build context, suitable for change
+// detection independent of the resulting image ID.
+func buildImage(client *client.Client, buildConfig map[string]interface{}, image string) (string, error) {
+	contextDir := buildConfig["context"].(string)
+
+	buildContext, err := tarBuildContext(contextDir)
+	if err != nil {
+		return "", fmt.Errorf("error tarring build context %s: %s", contextDir, err)
+	}
+
+	opts := buildImageOpts(buildConfig, image)
+
+	digest, err := buildContextDigest(buildConfig, opts)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.ImageBuild(context.Background(), buildContext, opts)
+	if err != nil {
+		return "", fmt.Errorf("error building image %s: %s", image, err)
+	}
+	defer resp.Body.Close()
+
+	if err := processStreamingOutput(resp.Body); err != nil {
+		return "", err
+	}
+
+	return digest, nil
+}
+
+// resourceDockerRegistryImageCustomizeDiff hashes the build context at plan
+// time so an edited Dockerfile/context forces source_digest into the diff
+// even when the build block's HCL is unchanged, giving source_digest the
+// automatic content-addressable change detection the resource promises.
+func resourceDockerRegistryImageCustomizeDiff(d *schema.ResourceDiff, meta interface{}) error {
+	v, ok := d.GetOk("build")
+	if !ok {
+		return nil
+	}
+	buildConfig := v.([]interface{})[0].(map[string]interface{})
+
+	digest, err := buildContextDigest(buildConfig, buildImageOpts(buildConfig, d.Get("name").(string)))
+	if err != nil {
+		return err
+	}
+
+	if digest != d.Get("source_digest").(string) {
+		return d.SetNew("source_digest", digest)
+	}
+
+	return nil
+}
+
+// tarBuildContext walks contextDir and produces a tar stream suitable for
+// client.ImageBuild.
+func tarBuildContext(contextDir string) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	err := filepath.Walk(contextDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(contextDir, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// hashBuildContext produces a deterministic sha256 digest of a build
+// context's contents by walking it in sorted order and hashing each file's
+// path, mode and content.
+func hashBuildContext(contextDir string) (string, error) {
+	var paths []string
+	infos := map[string]os.FileInfo{}
+
+	err := filepath.Walk(contextDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(contextDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		paths = append(paths, rel)
+		infos[rel] = info
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, rel := range paths {
+		info := infos[rel]
+		fmt.Fprintf(h, "%s\x00%o\x00", rel, info.Mode())
+
+		f, err := os.Open(filepath.Join(contextDir, rel))
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func pushImage(client *client.Client, authConfig *AuthConfigs, image string) error {
 	pullOpts := parseImageOptions(image)
 
@@ -97,6 +357,16 @@ func pushImage(client *client.Client, authConfig *AuthConfigs, image string) err
 		}
 	}
 
+	// Fall back to credential helpers / built-in cloud providers when no
+	// static credentials matched.
+	if auth.Username == "" {
+		registry, _ := normalizeRegistryRepository(pullOpts.Registry, pullOpts.Repository)
+		if username, password, err := fallbackRegistryCredentials(registry); err == nil {
+			auth.Username = username
+			auth.Password = password
+		}
+	}
+
 	encodedJSON, err := json.Marshal(auth)
 	if err != nil {
 		return fmt.Errorf("error creating auth config: %s", err)
@@ -114,101 +384,69 @@ func pushImage(client *client.Client, authConfig *AuthConfigs, image string) err
 }
 
 func removeRegistryImage(registry, image, manifest, username, password string) error {
-	client := http.DefaultClient
-
-	// Allow insecure registries only for ACC tests
-	// cuz we don't have a valid certs for this case
-	if env, okEnv := os.LookupEnv("TF_ACC"); okEnv {
-		if i, errConv := strconv.Atoi(env); errConv == nil && i >= 1 {
-			cfg := &tls.Config{
-				InsecureSkipVerify: true,
-			}
-			client.Transport = &http.Transport{
-				TLSClientConfig: cfg,
-			}
-		}
+	return newRegistryClient(registry, username, password).deleteManifest(image, manifest)
+}
+
+// attemptCrossRepoMounts tries to satisfy image's layers by mounting them
+// from the repositories listed in mountFrom instead of letting the daemon
+// upload them again, per the registry's cross-repository blob mount API.
+// It's a best-effort optimization: any layer that can't be resolved or
+// mounted is silently left for the daemon's normal push to upload.
+//
+// The layers the daemon is about to push are identified by compressed blob
+// digest, not by the uncompressed diffIDs ImageInspect reports under
+// RootFS: the registry stores and mounts blobs by their compressed digest.
+// image only has a known compressed manifest once it has round-tripped
+// through a registry at least once (e.g. it was pulled, then retagged),
+// which ImageInspect surfaces via RepoDigests, so that manifest is fetched
+// and its real layer digests are used instead.
+func attemptCrossRepoMounts(client *client.Client, authConfig *AuthConfigs, image string, mountFrom []string) {
+	if len(mountFrom) == 0 {
+		return
 	}
 
-	req, err := http.NewRequest("DELETE", "https://"+registry+"/v2/"+image+"/manifests/"+manifest, nil)
-	if err != nil {
-		return fmt.Errorf("Error creating registry request: %s", err)
+	pushOpts := parseImageOptions(image)
+	registry, repository := normalizeRegistryRepository(pushOpts.Registry, pushOpts.Repository)
+
+	inspect, _, err := client.ImageInspectWithRaw(context.Background(), image)
+	if err != nil || len(inspect.RepoDigests) == 0 {
+		return
 	}
 
-	if username != "" {
-		req.SetBasicAuth(username, password)
+	sourceRepository, sourceDigest, ok := splitRepoDigest(inspect.RepoDigests[0])
+	if !ok {
+		return
 	}
 
-	resp, err := client.Do(req)
+	rc := newRegistryClientForRegistry(authConfig, registry)
 
+	_, manifestBytes, err := rc.getManifest(sourceRepository, sourceDigest, mediaTypeManifest)
 	if err != nil {
-		return fmt.Errorf("Error during registry request: %s", err)
+		return
 	}
 
-	switch resp.StatusCode {
-	// Basic auth was valid or not needed
-	case http.StatusAccepted:
-		return nil
-
-	// Assume the manifest was deleted
-	case http.StatusNotFound:
-		return nil
-
-	// Either OAuth is required or the basic auth creds were invalid
-	case http.StatusUnauthorized:
-		if strings.HasPrefix(resp.Header.Get("www-authenticate"), "Bearer") {
-			auth := parseAuthHeader(resp.Header.Get("www-authenticate"))
-			params := url.Values{}
-			params.Set("service", auth["service"])
-			params.Set("scope", auth["scope"])
-			tokenRequest, err := http.NewRequest("GET", auth["realm"]+"?"+params.Encode(), nil)
-
-			if err != nil {
-				return fmt.Errorf("Error creating registry request: %s", err)
-			}
-
-			if username != "" {
-				tokenRequest.SetBasicAuth(username, password)
-			}
-
-			tokenResponse, err := client.Do(tokenRequest)
-
-			if err != nil {
-				return fmt.Errorf("Error during registry request: %s", err)
-			}
-
-			if tokenResponse.StatusCode != http.StatusOK {
-				return fmt.Errorf("Got bad response from registry: " + tokenResponse.Status)
-			}
-
-			body, err := ioutil.ReadAll(tokenResponse.Body)
-			if err != nil {
-				return fmt.Errorf("Error reading response body: %s", err)
-			}
-
-			token := &TokenResponse{}
-			err = json.Unmarshal(body, token)
-			if err != nil {
-				return fmt.Errorf("Error parsing OAuth token response: %s", err)
-			}
-
-			req.Header.Set("Authorization", "Bearer "+token.Token)
-			digestResponse, err := client.Do(req)
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return
+	}
 
-			if err != nil {
-				return fmt.Errorf("Error during registry request: %s", err)
+	for _, layer := range manifest.Layers {
+		for _, from := range mountFrom {
+			exists, err := rc.headBlob(from, layer.Digest)
+			if err != nil || !exists {
+				continue
 			}
-
-			if digestResponse.StatusCode != http.StatusOK {
-				return fmt.Errorf("Got bad response from registry: " + digestResponse.Status)
+			if mounted, err := rc.mountBlob(repository, layer.Digest, from); err == nil && mounted {
+				break
 			}
-
-			return nil
 		}
+	}
+}
 
-		return fmt.Errorf("Bad credentials: " + resp.Status)
-
-		// Some unexpected status was given, return an error
-	default:
-		return fmt.Errorf("Got bad response from registry: " + resp.Status)
+func stringListFromSchema(raw []interface{}) []string {
+	out := make([]string, 0, len(raw))
+	for _, v := range raw {
+		out = append(out, v.(string))
 	}
+	return out
 }
@@ -0,0 +1,70 @@
+package docker
+
+import (
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func resourceDockerRegistryManifest() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceDockerRegistryManifestCreate,
+		Read:   resourceDockerRegistryManifestRead,
+		Update: resourceDockerRegistryManifestUpdate,
+		Delete: resourceDockerRegistryManifestDelete,
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"manifest": {
+				Type:     schema.TypeList,
+				Required: true,
+				MinItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"image": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"platform": {
+							Type:     schema.TypeList,
+							Required: true,
+							MaxItems: 1,
+							Elem: &schema.Resource{
+								Schema: map[string]*schema.Schema{
+									"os": {
+										Type:     schema.TypeString,
+										Required: true,
+									},
+
+									"architecture": {
+										Type:     schema.TypeString,
+										Required: true,
+									},
+
+									"variant": {
+										Type:     schema.TypeString,
+										Optional: true,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+
+			"sha256_digest": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"keep_remote": {
+				Type:     schema.TypeBool,
+				Optional: true,
+			},
+		},
+	}
+}
@@ -0,0 +1,139 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+type manifestListPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type manifestListDescriptor struct {
+	MediaType string               `json:"mediaType"`
+	Size      int64                `json:"size"`
+	Digest    string               `json:"digest"`
+	Platform  manifestListPlatform `json:"platform"`
+}
+
+type manifestList struct {
+	SchemaVersion int                      `json:"schemaVersion"`
+	MediaType     string                   `json:"mediaType"`
+	Manifests     []manifestListDescriptor `json:"manifests"`
+}
+
+func resourceDockerRegistryManifestCreate(d *schema.ResourceData, meta interface{}) error {
+	name := d.Get("name").(string)
+	authConfigs := meta.(*ProviderConfig).AuthConfigs
+
+	pushOpts := parseImageOptions(name)
+	pushOpts.Registry, pushOpts.Repository = normalizeRegistryRepository(pushOpts.Registry, pushOpts.Repository)
+	pushOpts.Tag = normalizeTag(pushOpts.Tag)
+
+	username, password := credentialsForRegistry(authConfigs, pushOpts.Registry)
+
+	list := manifestList{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeManifestList,
+	}
+
+	for _, v := range d.Get("manifest").([]interface{}) {
+		m := v.(map[string]interface{})
+		platform := m["platform"].([]interface{})[0].(map[string]interface{})
+
+		childOpts := parseImageOptions(m["image"].(string))
+		if childOpts.Registry == "" {
+			childOpts.Registry = pushOpts.Registry
+		}
+		childOpts.Registry, childOpts.Repository = normalizeRegistryRepository(childOpts.Registry, childOpts.Repository)
+		childOpts.Tag = normalizeTag(childOpts.Tag)
+		childUsername, childPassword := credentialsForRegistry(authConfigs, childOpts.Registry)
+
+		digest, body, err := newRegistryClient(childOpts.Registry, childUsername, childPassword).
+			getManifest(childOpts.Repository, childOpts.Tag, mediaTypeManifest)
+		if err != nil {
+			return fmt.Errorf("Unable to resolve digest for %s: %s", m["image"].(string), err)
+		}
+
+		list.Manifests = append(list.Manifests, manifestListDescriptor{
+			MediaType: mediaTypeManifest,
+			Size:      int64(len(body)),
+			Digest:    digest,
+			Platform: manifestListPlatform{
+				OS:           platform["os"].(string),
+				Architecture: platform["architecture"].(string),
+				Variant:      platform["variant"].(string),
+			},
+		})
+	}
+
+	payload, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal manifest list: %s", err)
+	}
+
+	digest, err := newRegistryClient(pushOpts.Registry, username, password).
+		putManifest(pushOpts.Repository, pushOpts.Tag, mediaTypeManifestList, payload)
+	if err != nil {
+		return fmt.Errorf("Unable to push manifest list: %s", err)
+	}
+
+	d.Set("sha256_digest", digest)
+	d.SetId(name)
+	return nil
+}
+
+func resourceDockerRegistryManifestRead(d *schema.ResourceData, meta interface{}) error {
+	return nil
+}
+
+func resourceDockerRegistryManifestUpdate(d *schema.ResourceData, meta interface{}) error {
+	return resourceDockerRegistryManifestCreate(d, meta)
+}
+
+func resourceDockerRegistryManifestDelete(d *schema.ResourceData, meta interface{}) error {
+	if keepRemote := d.Get("keep_remote").(bool); keepRemote {
+		return nil
+	}
+
+	pullOpts := parseImageOptions(d.Get("name").(string))
+	digest := d.Get("sha256_digest").(string)
+	authConfig := meta.(*ProviderConfig).AuthConfigs
+
+	pullOpts.Registry, pullOpts.Repository = normalizeRegistryRepository(pullOpts.Registry, pullOpts.Repository)
+	pullOpts.Tag = normalizeTag(pullOpts.Tag)
+
+	username, password := credentialsForRegistry(authConfig, pullOpts.Registry)
+
+	err := removeRegistryImage(pullOpts.Registry, pullOpts.Repository, digest, username, password)
+	if err != nil {
+		return fmt.Errorf("Unable to remove manifest list: %s", err)
+	}
+
+	d.SetId("")
+	return nil
+}
+
+// credentialsForRegistry looks up static username/password credentials for
+// registry from authConfig, falling back to credential helpers / the
+// built-in cloud providers when nothing static is configured.
+func credentialsForRegistry(authConfig *AuthConfigs, registry string) (string, string) {
+	if auth, ok := authConfig.Configs[normalizeRegistryAddress(registry)]; ok && auth.Username != "" {
+		return auth.Username, auth.Password
+	}
+
+	if username, password, err := fallbackRegistryCredentials(registry); err == nil {
+		return username, password
+	}
+
+	return "", ""
+}
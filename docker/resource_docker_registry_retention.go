@@ -0,0 +1,65 @@
+package docker
+
+import (
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func resourceDockerRegistryRetention() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceDockerRegistryRetentionApply,
+		Read:   resourceDockerRegistryRetentionRead,
+		Update: resourceDockerRegistryRetentionApply,
+		Delete: resourceDockerRegistryRetentionDelete,
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"keep_last_n": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  0,
+			},
+
+			"keep_newer_than": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"keep_matching": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			"dry_run": {
+				Type:     schema.TypeBool,
+				Optional: true,
+			},
+
+			// allow_delete_all must be set when none of keep_last_n,
+			// keep_newer_than or keep_matching is configured, as an explicit
+			// opt-in to deleting every tag in the repository instead of that
+			// being the unguarded default.
+			"allow_delete_all": {
+				Type:     schema.TypeBool,
+				Optional: true,
+			},
+
+			"deleted_digests": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			"skipped_tags": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+		},
+	}
+}
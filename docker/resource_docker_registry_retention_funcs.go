@@ -0,0 +1,194 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// registryManifestConfig is the subset of a v2 image manifest needed to
+// resolve its config blob, which in turn carries the image's creation time.
+// MediaType is checked first: a multi-arch tag resolves to a manifest list
+// with no config, and must be skipped rather than treated as a single-image
+// manifest.
+type registryManifestConfig struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+}
+
+// registryImageConfig is the subset of an image config blob needed for
+// retention decisions.
+type registryImageConfig struct {
+	Created time.Time `json:"created"`
+}
+
+type retentionCandidate struct {
+	tag     string
+	digest  string
+	created time.Time
+}
+
+func resourceDockerRegistryRetentionApply(d *schema.ResourceData, meta interface{}) error {
+	name := d.Get("name").(string)
+	authConfig := meta.(*ProviderConfig).AuthConfigs
+
+	repoOpts := parseImageOptions(name)
+	repoOpts.Registry, repoOpts.Repository = normalizeRegistryRepository(repoOpts.Registry, repoOpts.Repository)
+
+	username, password := credentialsForRegistry(authConfig, repoOpts.Registry)
+	rc := newRegistryClient(repoOpts.Registry, username, password)
+
+	tags, err := rc.listTags(repoOpts.Repository)
+	if err != nil {
+		return fmt.Errorf("Unable to list tags for %s: %s", repoOpts.Repository, err)
+	}
+
+	candidates := make([]retentionCandidate, 0, len(tags))
+	skipped := make([]string, 0)
+	for _, tag := range tags {
+		digest, manifestBody, err := rc.getManifest(repoOpts.Repository, tag, mediaTypeManifest)
+		if err != nil {
+			return fmt.Errorf("Unable to resolve manifest for %s:%s: %s", repoOpts.Repository, tag, err)
+		}
+
+		var manifest registryManifestConfig
+		if err := json.Unmarshal(manifestBody, &manifest); err != nil {
+			return fmt.Errorf("Unable to parse manifest %s: %s", digest, err)
+		}
+
+		// A multi-arch tag resolves to a manifest list with no config blob
+		// of its own; retention has no single creation time to judge it by,
+		// so it's left alone rather than failing the whole apply.
+		if manifest.MediaType == mediaTypeManifestList || manifest.Config.Digest == "" {
+			skipped = append(skipped, tag)
+			continue
+		}
+
+		configBody, err := rc.getBlob(repoOpts.Repository, manifest.Config.Digest)
+		if err != nil {
+			return fmt.Errorf("Unable to fetch image config %s: %s", manifest.Config.Digest, err)
+		}
+
+		var imageConfig registryImageConfig
+		if err := json.Unmarshal(configBody, &imageConfig); err != nil {
+			return fmt.Errorf("Unable to parse image config %s: %s", manifest.Config.Digest, err)
+		}
+
+		candidates = append(candidates, retentionCandidate{
+			tag:     tag,
+			digest:  digest,
+			created: imageConfig.Created,
+		})
+	}
+
+	toDelete, err := retentionDeletions(d, candidates)
+	if err != nil {
+		return err
+	}
+
+	dryRun := d.Get("dry_run").(bool)
+	deleted := make([]string, 0, len(toDelete))
+	for _, candidate := range toDelete {
+		if !dryRun {
+			if err := rc.deleteManifest(repoOpts.Repository, candidate.digest); err != nil {
+				return fmt.Errorf("Unable to delete manifest %s: %s", candidate.digest, err)
+			}
+		}
+		deleted = append(deleted, candidate.digest)
+	}
+
+	d.Set("deleted_digests", deleted)
+	d.Set("skipped_tags", skipped)
+	d.SetId(name)
+	return nil
+}
+
+// retentionDeletions applies the keep_last_n / keep_newer_than /
+// keep_matching policy to candidates and returns the ones that should be
+// removed. A candidate is kept if it satisfies any keep rule.
+func retentionDeletions(d *schema.ResourceData, candidates []retentionCandidate) ([]retentionCandidate, error) {
+	keepLastN := d.Get("keep_last_n").(int)
+
+	var keepNewerThan time.Duration
+	if v := d.Get("keep_newer_than").(string); v != "" {
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid keep_newer_than duration %q: %s", v, err)
+		}
+		keepNewerThan = duration
+	}
+
+	keepMatching := make([]*regexp.Regexp, 0)
+	for _, pattern := range d.Get("keep_matching").([]interface{}) {
+		re, err := regexp.Compile(pattern.(string))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid keep_matching pattern %q: %s", pattern.(string), err)
+		}
+		keepMatching = append(keepMatching, re)
+	}
+
+	if keepLastN == 0 && keepNewerThan == 0 && len(keepMatching) == 0 && !d.Get("allow_delete_all").(bool) {
+		return nil, fmt.Errorf("none of keep_last_n, keep_newer_than or keep_matching is set, which would delete every tag; set allow_delete_all to true to confirm that's intended")
+	}
+
+	sorted := make([]retentionCandidate, len(candidates))
+	copy(sorted, candidates)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].created.After(sorted[j].created)
+	})
+
+	// A digest is kept if ANY tag pointing at it is kept: deleting by digest
+	// (the only thing the registry's DELETE manifest API supports) removes
+	// every tag that shares it, so a digest can't be deleted just because
+	// one of its aliases lost out to keep_last_n/keep_newer_than/keep_matching.
+	keptDigests := make(map[string]bool)
+	var candidateDeletes []retentionCandidate
+	for i, candidate := range sorted {
+		keep := keepLastN > 0 && i < keepLastN
+		if !keep && keepNewerThan > 0 && time.Since(candidate.created) < keepNewerThan {
+			keep = true
+		}
+		if !keep {
+			for _, re := range keepMatching {
+				if re.MatchString(candidate.tag) {
+					keep = true
+					break
+				}
+			}
+		}
+
+		if keep {
+			keptDigests[candidate.digest] = true
+			continue
+		}
+
+		candidateDeletes = append(candidateDeletes, candidate)
+	}
+
+	seenDigests := make(map[string]bool)
+	var toDelete []retentionCandidate
+	for _, candidate := range candidateDeletes {
+		if keptDigests[candidate.digest] || seenDigests[candidate.digest] {
+			continue
+		}
+		seenDigests[candidate.digest] = true
+		toDelete = append(toDelete, candidate)
+	}
+
+	return toDelete, nil
+}
+
+func resourceDockerRegistryRetentionRead(d *schema.ResourceData, meta interface{}) error {
+	return nil
+}
+
+func resourceDockerRegistryRetentionDelete(d *schema.ResourceData, meta interface{}) error {
+	d.SetId("")
+	return nil
+}